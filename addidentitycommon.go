@@ -0,0 +1,56 @@
+package obligator
+
+import (
+	"net/http"
+)
+
+const loginCookieLifetime = 86400 * 365
+
+// addIdentityToLoginCookie appends identity to the caller's existing
+// "identities" claim (if any) and re-issues the login cookie, so a user who
+// adds a second identity (e.g. email after OAuth2) ends up with both tied
+// to one session instead of the new one silently replacing the old.
+func addIdentityToLoginCookie(r *http.Request, db Database, jose *JOSE, w http.ResponseWriter, identity *Identity) error {
+
+	identities := []*Identity{identity}
+
+	if existing, err := getLoginCookie(db, r); err == nil {
+		if parsed, err := jose.Parse(existing.Value); err == nil {
+			if identsInterface, ok := parsed.Get("identities"); ok {
+				if tokIdents, ok := identsInterface.([]*Identity); ok {
+					identities = append(tokIdents, identity)
+				}
+			}
+		}
+	}
+
+	newJwt, err := jose.NewJWT(map[string]interface{}{
+		"identities": identities,
+	})
+	if err != nil {
+		return err
+	}
+
+	cookieDomain, err := buildCookieDomain(r.Host)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := db.GetPrefix()
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Domain:   cookieDomain,
+		Name:     prefix + "login_key",
+		Value:    newJwt,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   loginCookieLifetime,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
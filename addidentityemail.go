@@ -0,0 +1,295 @@
+package obligator
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ip2location/ip2location-go/v9"
+)
+
+const emailValidationLifetime = 10 * time.Minute
+
+// AddIdentityEmailHandler serves the passwordless email login flow: /login-email
+// sends a magic link (and a short fallback code, for clients that can't
+// follow the link on the same device) via the configured Mailer, and the
+// user redeems either one at /magic or /complete-email-login to add an
+// email Identity to their login cookie.
+type AddIdentityEmailHandler struct {
+	mux *http.ServeMux
+}
+
+func NewAddIdentityEmailHandler(db Database, cluster *Cluster, tmpl *template.Template, behindProxy bool, geoDb *ip2location.DB, jose *JOSE, mailer Mailer) *AddIdentityEmailHandler {
+
+	mux := http.NewServeMux()
+	h := &AddIdentityEmailHandler{mux: mux}
+
+	mux.HandleFunc("/login-email", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !cluster.IAmThePrimary() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "not the primary")
+			return
+		}
+
+		r.ParseForm()
+
+		email := r.Form.Get("email")
+		if email == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "email is required")
+			return
+		}
+
+		allowed, err := db.CheckEmailRateLimit(email, EmailValidationsPerTimeLimit, RateLimitTime)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if !allowed {
+			RecordEmailRateLimitRejected()
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, "too many sign-in emails sent to this address recently")
+			return
+		}
+
+		token, err := randomUrlSafeToken(32)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		code, err := randomUrlSafeToken(4)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.CreateEmailValidationRequest(&EmailValidationRequest{
+			Email:     email,
+			Token:     token,
+			Code:      code,
+			ReturnUri: r.Form.Get("return_uri"),
+			ExpiresAt: time.Now().Add(emailValidationLifetime),
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		displayName := domainToUri(r.Host)
+		locale := localeFromAcceptLanguage(r.Header.Get("Accept-Language"))
+
+		err = mailer.Send(r.Context(), email, MailTemplateMagicLink, locale, struct {
+			DisplayName string
+			MagicLink   string
+		}{
+			DisplayName: displayName,
+			MagicLink:   fmt.Sprintf("%s/magic?token=%s", domainToUri(r.Host), token),
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		RecordEmailMagicLinkSent()
+
+		err = mailer.Send(r.Context(), email, MailTemplateCode, locale, struct {
+			DisplayName string
+			Code        string
+		}{
+			DisplayName: displayName,
+			Code:        code,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		setReturnUriCookie(r.Host, db, r.Form.Get("return_uri"), w)
+
+		data := struct {
+			*commonData
+			Email string
+		}{
+			commonData: newCommonData(nil, db, r),
+			Email:      email,
+		}
+
+		err = tmpl.ExecuteTemplate(w, "email-sent.html", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+		}
+	})
+
+	mux.HandleFunc("/email-sent", func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			*commonData
+		}{
+			commonData: newCommonData(nil, db, r),
+		}
+
+		err := tmpl.ExecuteTemplate(w, "email-sent.html", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+		}
+	})
+
+	completeLogin := func(w http.ResponseWriter, r *http.Request, req *EmailValidationRequest) {
+
+		remoteIp, err := getRemoteIp(r, behindProxy)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		identity := &Identity{
+			IdType:        IdentityTypeEmail,
+			Id:            req.Email,
+			ProviderName:  "email",
+			Email:         req.Email,
+			EmailVerified: true,
+		}
+
+		err = addIdentityToLoginCookie(r, db, jose, w, identity)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.RecordLogin(&Login{
+			IdType:       identity.IdType,
+			Id:           identity.Id,
+			ProviderName: identity.ProviderName,
+			Timestamp:    time.Now().Format(time.RFC3339),
+		})
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+		sendSecurityAlertMail(r.Context(), mailer, geoDb, remoteIp, req.Email, r.Host)
+
+		returnUri := req.ReturnUri
+		if returnUri == "" {
+			returnUri = "/login"
+		}
+
+		http.Redirect(w, r, returnUri, http.StatusSeeOther)
+	}
+
+	mux.HandleFunc("/magic", func(w http.ResponseWriter, r *http.Request) {
+
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "token is required")
+			return
+		}
+
+		req, err := db.GetEmailValidationRequestByToken(token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "invalid or expired magic link")
+			return
+		}
+
+		completeLogin(w, r, req)
+	})
+
+	mux.HandleFunc("/confirm-magic", func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			*commonData
+		}{
+			commonData: newCommonData(nil, db, r),
+		}
+
+		err := tmpl.ExecuteTemplate(w, "confirm-magic.html", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+		}
+	})
+
+	mux.HandleFunc("/complete-email-login", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.ParseForm()
+
+		email := r.Form.Get("email")
+		code := r.Form.Get("code")
+
+		req, err := db.GetEmailValidationRequestByEmailAndCode(email, code)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "invalid or expired code")
+			return
+		}
+
+		completeLogin(w, r, req)
+	})
+
+	return h
+}
+
+func (h *AddIdentityEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// EmailValidationRequest is a pending magic-link/code sign-in issued by
+// /login-email, redeemed once by either /magic or /complete-email-login.
+type EmailValidationRequest struct {
+	Email     string
+	Token     string
+	Code      string
+	ReturnUri string
+	ExpiresAt time.Time
+}
+
+// sendSecurityAlertMail best-effort notifies to of a new sign-in, describing
+// the location geoDb resolves remoteIp to when a GeoIP database is
+// configured, or just the IP otherwise. Failure to send isn't fatal to the
+// login itself, so errors are only logged.
+func sendSecurityAlertMail(ctx context.Context, mailer Mailer, geoDb *ip2location.DB, remoteIp, to, host string) {
+
+	event := remoteIp
+
+	if geoDb != nil {
+		if rec, err := geoDb.Get_all(remoteIp); err == nil && rec.City != "" {
+			event = fmt.Sprintf("%s (%s, %s)", remoteIp, rec.City, rec.Country_long)
+		}
+	}
+
+	err := mailer.Send(ctx, to, MailTemplateSecurityAlert, defaultMailLocale, struct {
+		DisplayName string
+		Event       string
+	}{
+		DisplayName: domainToUri(host),
+		Event:       event,
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("addidentityemail: failed to send security alert to %s: %s", to, err.Error()))
+	}
+}
@@ -0,0 +1,216 @@
+package obligator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nbeirne/obligator/providers"
+)
+
+const oauth2LoginRequestLifetime = 10 * time.Minute
+
+// AddIdentityOauth2Handler serves the OAuth2/OIDC login flow at /login-oauth2
+// and /callback. It resolves the requested OAuth2Provider to a
+// providers.Provider via newProvider (providers.New in production, a fake in
+// tests) so Google/GitHub/GitLab/Keycloak/Bitbucket/Mastodon/login.gov get
+// their pre-built profiles and anything else falls back to the generic
+// OIDC-discovery-based provider.
+type AddIdentityOauth2Handler struct {
+	mux *http.ServeMux
+}
+
+func NewAddIdentityOauth2Handler(db Database, oauth2MetaMan *OAuth2MetadataManager, jose *JOSE, newProvider func(ctx context.Context, conf providers.Config) (providers.Provider, error)) *AddIdentityOauth2Handler {
+
+	mux := http.NewServeMux()
+	h := &AddIdentityOauth2Handler{mux: mux}
+
+	mux.HandleFunc("/login-oauth2", func(w http.ResponseWriter, r *http.Request) {
+
+		providerId := r.URL.Query().Get("provider_id")
+
+		prov, err := oauth2MetaMan.Get(providerId)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		state, err := randomUrlSafeToken(32)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		pkce, err := newPkce()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.CreateOAuth2LoginRequest(&OAuth2LoginRequest{
+			State:        state,
+			ProviderId:   providerId,
+			PkceVerifier: pkce.Verifier,
+			ReturnUri:    r.URL.Query().Get("return_uri"),
+			ExpiresAt:    time.Now().Add(oauth2LoginRequestLifetime),
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		conf := oauth2ProviderToConfig(prov, domainToUri(r.Host)+"/callback")
+
+		provider, err := newProvider(r.Context(), conf)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, provider.AuthURL(state, pkce), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+
+		q := r.URL.Query()
+
+		loginReq, err := db.GetOAuth2LoginRequestByState(q.Get("state"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid or expired oauth2 login request")
+			return
+		}
+
+		prov, err := oauth2MetaMan.Get(loginReq.ProviderId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		conf := oauth2ProviderToConfig(prov, domainToUri(r.Host)+"/callback")
+
+		provider, err := newProvider(r.Context(), conf)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		pkce := &providers.PKCE{Verifier: loginReq.PkceVerifier}
+
+		exchangeStart := time.Now()
+		token, err := provider.Exchange(r.Context(), q.Get("code"), pkce)
+		RecordOAuth2ExchangeDuration(provider.Type(), time.Since(exchangeStart))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		upstreamIdent, err := provider.FetchIdentity(r.Context(), token)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		identity := &Identity{
+			IdType:        provider.Type(),
+			Id:            upstreamIdent.Id,
+			ProviderName:  prov.Name,
+			Name:          upstreamIdent.Name,
+			Email:         upstreamIdent.Email,
+			EmailVerified: upstreamIdent.EmailVerified,
+		}
+
+		err = addIdentityToLoginCookie(r, db, jose, w, identity)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.RecordLogin(&Login{
+			IdType:       identity.IdType,
+			Id:           identity.Id,
+			ProviderName: identity.ProviderName,
+			Timestamp:    time.Now().Format(time.RFC3339),
+		})
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+		returnUri := loginReq.ReturnUri
+		if returnUri == "" {
+			returnUri = "/login"
+		}
+
+		http.Redirect(w, r, returnUri, http.StatusSeeOther)
+	})
+
+	return h
+}
+
+func (h *AddIdentityOauth2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// OAuth2LoginRequest is the short-lived, server-side record of an
+// in-progress OAuth2 login, keyed by the state value round-tripped through
+// the upstream provider so /callback can recover which provider and PKCE
+// verifier it belongs to.
+type OAuth2LoginRequest struct {
+	State        string
+	ProviderId   string
+	PkceVerifier string
+	ReturnUri    string
+	ExpiresAt    time.Time
+}
+
+// oauth2ProviderToConfig adapts a persisted OAuth2Provider to the
+// providers.Config the providers package expects, carrying over whichever
+// fields each provider profile actually reads (see providers.Config's doc
+// comment).
+func oauth2ProviderToConfig(prov *OAuth2Provider, redirectUri string) providers.Config {
+	return providers.Config{
+		Type:         prov.Type,
+		ClientId:     prov.ClientId,
+		ClientSecret: prov.ClientSecret,
+		RedirectUri:  redirectUri,
+		Scopes:       prov.Scopes,
+		AuthUri:      prov.AuthUri,
+		TokenUri:     prov.TokenUri,
+		UserinfoUri:  prov.UserinfoUri,
+		DiscoveryUri: prov.DiscoveryUri,
+		Realm:        prov.Realm,
+		ServerUri:    prov.ServerUri,
+		InstanceUri:  prov.InstanceUri,
+	}
+}
+
+// newPkce generates a fresh RFC 7636 S256 verifier/challenge pair for an
+// outgoing authorization request.
+func newPkce() (*providers.PKCE, error) {
+	verifier, err := randomUrlSafeToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return &providers.PKCE{
+		Verifier:  verifier,
+		Challenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+		Method:    "S256",
+	}, nil
+}
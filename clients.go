@@ -0,0 +1,183 @@
+package obligator
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nbeirne/obligator/clientstore"
+)
+
+// AdminClientsHandler exposes CRUD over registered OAuth2 clients at
+// /admin/clients and /admin/clients/{id}. It's gated the same way as the
+// rest of the admin surface: the caller must hold the "admin" role.
+type AdminClientsHandler struct {
+	mux *http.ServeMux
+}
+
+func NewAdminClientsHandler(db Database, store *clientstore.Store, jose *JOSE) *AdminClientsHandler {
+
+	mux := http.NewServeMux()
+
+	h := &AdminClientsHandler{mux: mux}
+
+	requireAdmin := func(w http.ResponseWriter, r *http.Request) bool {
+		validation, err := validate(db, r, jose, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return false
+		}
+
+		if validation == nil || !hasRole(validation.Roles, RoleAdmin) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "admin role required")
+			return false
+		}
+
+		return true
+	}
+
+	mux.HandleFunc("/admin/clients", func(w http.ResponseWriter, r *http.Request) {
+
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			clients, err := store.List()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			writeJson(w, clients)
+		case "POST":
+			var reg clientstore.ClientRegistration
+			err := json.NewDecoder(r.Body).Decode(&reg)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			registered, err := store.Register(reg)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			writeJson(w, registered)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/admin/clients/", func(w http.ResponseWriter, r *http.Request) {
+
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/admin/clients/")
+		if id == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			client, err := store.Get(id)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			writeJson(w, client)
+		case "DELETE":
+			err := store.Delete(id)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	return h
+}
+
+func (h *AdminClientsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// ClientRegistrationHandler implements the public dynamic client
+// registration endpoint from RFC 7591. It's registered at /register,
+// replacing the previous oidcHandler stub there.
+type ClientRegistrationHandler struct {
+	store *clientstore.Store
+}
+
+func NewClientRegistrationHandler(store *clientstore.Store) *ClientRegistrationHandler {
+	return &ClientRegistrationHandler{store: store}
+}
+
+type clientRegistrationRequest struct {
+	ClientName              string   `json:"client_name"`
+	RedirectUris            []string `json:"redirect_uris"`
+	Scope                   string   `json:"scope"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+func (h *ClientRegistrationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req clientRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(req.RedirectUris) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "redirect_uris is required")
+		return
+	}
+
+	reg := clientstore.ClientRegistration{
+		Name:         req.ClientName,
+		RedirectUris: req.RedirectUris,
+		Scopes:       strings.Fields(req.Scope),
+		Public:       req.TokenEndpointAuthMethod == "none",
+	}
+
+	registered, err := h.store.Register(reg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJson(w, registered)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(v)
+}
@@ -0,0 +1,212 @@
+// Package clientstore persists registered OAuth2 clients: their client
+// secret, redirect URIs, allowed scopes, and per-user consent records.
+package clientstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Client is a registered OAuth2 client.
+type Client struct {
+	Id           string    `json:"client_id"`
+	Name         string    `json:"client_name"`
+	SecretHash   string    `json:"-"`
+	RedirectUris []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// RegisteredClient is returned once, at registration time, since it's the
+// only point at which the plaintext client secret is available.
+type RegisteredClient struct {
+	*Client
+	Secret string `json:"client_secret,omitempty"`
+}
+
+// ClientRegistration is the caller-supplied half of a Client.
+type ClientRegistration struct {
+	Name         string
+	RedirectUris []string
+	Scopes       []string
+	Public       bool
+}
+
+var ErrClientNotFound = errors.New("clientstore: client not found")
+var ErrInvalidSecret = errors.New("clientstore: invalid client secret")
+var ErrInvalidRedirectUri = errors.New("clientstore: redirect_uri not registered for client")
+
+// Database is the persistence obligator's Database interface must provide
+// for clientstore to function. It's satisfied structurally by obligator's
+// Database implementations without clientstore needing to import the
+// obligator package.
+type Database interface {
+	SetClient(c *Client) error
+	GetClient(id string) (*Client, error)
+	DeleteClient(id string) error
+	GetClients() ([]*Client, error)
+	SetConsent(userId, clientId string, scopes []string) error
+	GetConsent(userId, clientId string) ([]string, bool, error)
+}
+
+type Store struct {
+	db Database
+}
+
+func NewStore(db Database) *Store {
+	return &Store{db: db}
+}
+
+// Register creates a new client, generating a client_id and (for
+// confidential clients) a client_secret. The plaintext secret is only ever
+// returned here; the store only ever persists its hash.
+func (s *Store) Register(reg ClientRegistration) (*RegisteredClient, error) {
+
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret string
+	var secretHash string
+	if !reg.Public {
+		secret, err = randomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		secretHash = hashSecret(secret)
+	}
+
+	client := &Client{
+		Id:           id,
+		Name:         reg.Name,
+		SecretHash:   secretHash,
+		RedirectUris: reg.RedirectUris,
+		Scopes:       reg.Scopes,
+		Public:       reg.Public,
+		CreatedAt:    time.Now(),
+	}
+
+	err = s.db.SetClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegisteredClient{Client: client, Secret: secret}, nil
+}
+
+func (s *Store) Get(id string) (*Client, error) {
+	return s.db.GetClient(id)
+}
+
+func (s *Store) List() ([]*Client, error) {
+	return s.db.GetClients()
+}
+
+func (s *Store) Delete(id string) error {
+	return s.db.DeleteClient(id)
+}
+
+// Authenticate implements client_secret_basic / client_secret_post
+// authentication for confidential clients. Public clients (Public == true)
+// have no secret and authenticate via PKCE instead, so callers should check
+// Client.Public before calling this.
+func (s *Store) Authenticate(id, secret string) (*Client, error) {
+
+	client, err := s.db.GetClient(id)
+	if err != nil {
+		return nil, ErrClientNotFound
+	}
+
+	if client.Public {
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrInvalidSecret
+	}
+
+	return client, nil
+}
+
+func (s *Store) ValidateRedirectUri(client *Client, redirectUri string) error {
+	for _, u := range client.RedirectUris {
+		if u == redirectUri {
+			return nil
+		}
+	}
+
+	return ErrInvalidRedirectUri
+}
+
+// ValidateScopes returns the subset of requested that the client is allowed
+// to request.
+func (s *Store) ValidateScopes(client *Client, requested []string) []string {
+	allowed := map[string]bool{}
+	for _, sc := range client.Scopes {
+		allowed[sc] = true
+	}
+
+	var granted []string
+	for _, sc := range requested {
+		if allowed[sc] {
+			granted = append(granted, sc)
+		}
+	}
+
+	return granted
+}
+
+// HasConsent reports whether userId has already consented to clientId for
+// every scope in scopes, so the approval screen can be skipped on repeat
+// authorizations.
+func (s *Store) HasConsent(userId, clientId string, scopes []string) (bool, error) {
+
+	grantedScopes, exists, err := s.db.GetConsent(userId, clientId)
+	if err != nil {
+		return false, err
+	}
+
+	if !exists {
+		return false, nil
+	}
+
+	granted := map[string]bool{}
+	for _, sc := range grantedScopes {
+		granted[sc] = true
+	}
+
+	for _, sc := range scopes {
+		if !granted[sc] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *Store) RecordConsent(userId, clientId string, scopes []string) error {
+	return s.db.SetConsent(userId, clientId, scopes)
+}
+
+func randomToken(numBytes int) (string, error) {
+	b := make([]byte, numBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("clientstore: failed to generate random token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
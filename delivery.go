@@ -0,0 +1,79 @@
+package obligator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Delivery abstracts the concrete HTTP server obligator runs on top of, so
+// that high-throughput deployments can swap in an alternative transport
+// (e.g. fasthttp) without touching any handler code. Handlers are always
+// written against net/http types; a Delivery implementation is responsible
+// for adapting them to whatever it runs underneath.
+type Delivery interface {
+	Register(pattern string, handler http.HandlerFunc)
+	Start(addr string) error
+	Stop(ctx context.Context) error
+}
+
+const DeliveryNetHTTP = "net/http"
+const DeliveryFastHTTP = "fasthttp"
+
+// fastHTTPDeliveryFactory is populated by fasthttpdelivery.go when built
+// with the `fasthttp` build tag. It's left nil otherwise so the default
+// build doesn't pull in the fasthttp dependency.
+var fastHTTPDeliveryFactory func() Delivery
+
+// NetHTTPDelivery is the default Delivery, implemented directly on top of
+// net/http. This is the delivery obligator has always used.
+type NetHTTPDelivery struct {
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+func NewNetHTTPDelivery() *NetHTTPDelivery {
+	return &NetHTTPDelivery{
+		mux: http.NewServeMux(),
+	}
+}
+
+func (d *NetHTTPDelivery) Register(pattern string, handler http.HandlerFunc) {
+	d.mux.HandleFunc(pattern, handler)
+}
+
+func (d *NetHTTPDelivery) Start(addr string) error {
+	d.server = &http.Server{
+		Addr:    addr,
+		Handler: d.mux,
+	}
+
+	return d.server.ListenAndServe()
+}
+
+func (d *NetHTTPDelivery) Stop(ctx context.Context) error {
+	if d.server == nil {
+		return nil
+	}
+
+	return d.server.Shutdown(ctx)
+}
+
+// newDelivery constructs the Delivery named by ServerConfig.Delivery,
+// falling back to NetHTTPDelivery if the name is empty or unrecognized (or
+// if fasthttp support wasn't compiled in).
+func newDelivery(name string) Delivery {
+	switch name {
+	case "", DeliveryNetHTTP:
+		return NewNetHTTPDelivery()
+	case DeliveryFastHTTP:
+		if fastHTTPDeliveryFactory == nil {
+			fmt.Println("WARNING: ServerConfig.Delivery is \"fasthttp\" but this binary wasn't built with the fasthttp build tag; falling back to net/http")
+			return NewNetHTTPDelivery()
+		}
+		return fastHTTPDeliveryFactory()
+	default:
+		fmt.Println(fmt.Sprintf("WARNING: unknown ServerConfig.Delivery %q; falling back to net/http", name))
+		return NewNetHTTPDelivery()
+	}
+}
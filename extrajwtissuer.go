@@ -0,0 +1,241 @@
+package obligator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// JwtIssuerConfig describes a third-party OIDC issuer that obligator should
+// accept Bearer tokens from when validating forward-auth requests, in
+// addition to its own login cookie. This lets non-browser clients (CLI, CI,
+// other services) authenticate to obligator-protected upstreams without a
+// browser session.
+type JwtIssuerConfig struct {
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience,omitempty"`
+}
+
+const extraJwtIssuerRefreshInterval = 1 * time.Hour
+
+type oidcDiscoveryDoc struct {
+	Issuer  string `json:"issuer"`
+	JwksUri string `json:"jwks_uri"`
+}
+
+type extraJwtIssuer struct {
+	conf JwtIssuerConfig
+
+	mutex   sync.RWMutex
+	keySet  jwk.Set
+	jwksUri string
+}
+
+// ExtraJwtIssuerManager fetches and caches OIDC discovery documents and JWKS
+// for a set of configured issuers, periodically refreshing them, and
+// verifies incoming bearer tokens against them.
+type ExtraJwtIssuerManager struct {
+	issuers   []*extraJwtIssuer
+	roleClaim string
+}
+
+func NewExtraJwtIssuerManager(confs []JwtIssuerConfig, roleClaim string) (*ExtraJwtIssuerManager, error) {
+
+	m := &ExtraJwtIssuerManager{
+		roleClaim: roleClaim,
+	}
+
+	for _, conf := range confs {
+		iss := &extraJwtIssuer{
+			conf: conf,
+		}
+
+		err := iss.refresh()
+		if err != nil {
+			// Don't let a transient discovery/JWKS failure for one issuer
+			// take down the whole server at startup; refreshLoop will keep
+			// retrying, same as for a failed periodic refresh.
+			fmt.Println(fmt.Sprintf("extrajwtissuer: failed to init issuer %s: %s", conf.Issuer, err.Error()))
+		}
+
+		m.issuers = append(m.issuers, iss)
+	}
+
+	go m.refreshLoop()
+
+	return m, nil
+}
+
+func (m *ExtraJwtIssuerManager) refreshLoop() {
+	ticker := time.NewTicker(extraJwtIssuerRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, iss := range m.issuers {
+			err := iss.refresh()
+			if err != nil {
+				fmt.Println(fmt.Sprintf("extrajwtissuer: refresh failed for %s: %s", iss.conf.Issuer, err.Error()))
+			}
+		}
+	}
+}
+
+func (iss *extraJwtIssuer) refresh() error {
+
+	discoUri := iss.conf.Issuer + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", discoUri, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("extrajwtissuer: discovery request to %s returned %d", discoUri, res.StatusCode)
+	}
+
+	var doc oidcDiscoveryDoc
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	if err != nil {
+		return err
+	}
+
+	if doc.JwksUri == "" {
+		return fmt.Errorf("extrajwtissuer: discovery document for %s has no jwks_uri", iss.conf.Issuer)
+	}
+
+	keySet, err := jwk.Fetch(context.Background(), doc.JwksUri)
+	if err != nil {
+		return err
+	}
+
+	iss.mutex.Lock()
+	iss.keySet = keySet
+	iss.jwksUri = doc.JwksUri
+	iss.mutex.Unlock()
+
+	return nil
+}
+
+func (iss *extraJwtIssuer) verify(tokenString string) (jwt.Token, error) {
+
+	iss.mutex.RLock()
+	keySet := iss.keySet
+	iss.mutex.RUnlock()
+
+	if keySet == nil {
+		return nil, errors.New("extrajwtissuer: no keys available for issuer")
+	}
+
+	opts := []jwt.ParseOption{
+		jwt.WithKeySet(keySet),
+		jwt.WithIssuer(iss.conf.Issuer),
+		jwt.WithValidate(true),
+	}
+
+	if iss.conf.Audience != "" {
+		opts = append(opts, jwt.WithAudience(iss.conf.Audience))
+	}
+
+	return jwt.Parse([]byte(tokenString), opts...)
+}
+
+// Validate checks tokenString against each configured issuer in turn,
+// returning a Validation derived from the first issuer that accepts it.
+func (m *ExtraJwtIssuerManager) Validate(tokenString string) (*Validation, error) {
+
+	if m == nil || len(m.issuers) == 0 {
+		return nil, errors.New("extrajwtissuer: no extra JWT issuers configured")
+	}
+
+	var lastErr error
+
+	for _, iss := range m.issuers {
+		tok, err := iss.verify(tokenString)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return validationFromJwt(tok, m.roleClaim)
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("extrajwtissuer: token rejected by all configured issuers")
+	}
+
+	return nil, lastErr
+}
+
+func validationFromJwt(tok jwt.Token, roleClaim string) (*Validation, error) {
+
+	groups := groupsFromClaim(tok, roleClaim)
+
+	if email, ok := tok.Get("email"); ok {
+		if emailStr, ok := email.(string); ok && emailStr != "" {
+			return &Validation{
+				IdType: IdentityTypeEmail,
+				Id:     emailStr,
+				Groups: groups,
+			}, nil
+		}
+	}
+
+	if tok.Subject() == "" {
+		return nil, errors.New("extrajwtissuer: token has neither email nor sub claim")
+	}
+
+	return &Validation{
+		IdType: "sub",
+		Id:     tok.Subject(),
+		Groups: groups,
+	}, nil
+}
+
+func groupsFromClaim(tok jwt.Token, roleClaim string) []string {
+
+	if roleClaim == "" {
+		return nil
+	}
+
+	claimInterface, ok := tok.Get(roleClaim)
+	if !ok {
+		return nil
+	}
+
+	switch v := claimInterface.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		groups := make([]string, 0, len(v))
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	default:
+		return nil
+	}
+}
+
+func bearerTokenFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) > len(prefix) && auth[:len(prefix)] == prefix {
+		return auth[len(prefix):]
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+//go:build fasthttp
+
+package obligator
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+func init() {
+	fastHTTPDeliveryFactory = func() Delivery {
+		return NewFastHTTPDelivery()
+	}
+}
+
+// FastHTTPDelivery runs obligator on top of valyala/fasthttp for
+// deployments doing many forward-auth validations per second. Registered
+// handlers are still ordinary http.HandlerFunc values; each is adapted to
+// fasthttp via fasthttpadaptor so handler code never has to know which
+// delivery it's running under.
+type FastHTTPDelivery struct {
+	mux    *http.ServeMux
+	server *fasthttp.Server
+}
+
+func NewFastHTTPDelivery() *FastHTTPDelivery {
+	return &FastHTTPDelivery{
+		mux: http.NewServeMux(),
+	}
+}
+
+func (d *FastHTTPDelivery) Register(pattern string, handler http.HandlerFunc) {
+	d.mux.HandleFunc(pattern, handler)
+}
+
+func (d *FastHTTPDelivery) Start(addr string) error {
+	fasthttpHandler := fasthttpadaptor.NewFastHTTPHandler(d.mux)
+
+	d.server = &fasthttp.Server{
+		Handler: fasthttpHandler,
+	}
+
+	return d.server.ListenAndServe(addr)
+}
+
+func (d *FastHTTPDelivery) Stop(ctx context.Context) error {
+	if d.server == nil {
+		return nil
+	}
+
+	return d.server.ShutdownWithContext(ctx)
+}
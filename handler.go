@@ -1,19 +1,21 @@
 package obligator
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 )
 
 type Handler struct {
 	mux *http.ServeMux
 }
 
-func NewHandler(db Database, conf ServerConfig, tmpl *template.Template, jose *JOSE) *Handler {
+func NewHandler(db Database, conf ServerConfig, tmpl *template.Template, jose *JOSE, extraJwtIssuerMan *ExtraJwtIssuerManager) *Handler {
 
 	mux := http.NewServeMux()
 
@@ -105,7 +107,11 @@ func NewHandler(db Database, conf ServerConfig, tmpl *template.Template, jose *J
 		url := fmt.Sprintf("%s/auth?client_id=%s&redirect_uri=%s&response_type=code&state=&scope=",
 			domainToUri(authServer), redirectUri, redirectUri)
 
-		validation, err := validate(db, r, jose)
+		validation, err := validate(db, r, jose, extraJwtIssuerMan)
+		if errors.Is(err, ErrTotpRequired) {
+			http.Redirect(w, r, "/2fa/verify", 307)
+			return
+		}
 		if err != nil {
 			fmt.Println(err)
 			http.Redirect(w, r, url, 307)
@@ -115,9 +121,13 @@ func NewHandler(db Database, conf ServerConfig, tmpl *template.Template, jose *J
 		if validation != nil {
 			w.Header().Set("Remote-Id-Type", validation.IdType)
 			w.Header().Set("Remote-Id", validation.Id)
+			w.Header().Set("Remote-Roles", strings.Join(validation.Roles, ","))
+			w.Header().Set("Remote-Groups", strings.Join(validation.Groups, ","))
 		} else {
 			w.Header().Set("Remote-Id-Type", "")
 			w.Header().Set("Remote-Id", "")
+			w.Header().Set("Remote-Roles", "")
+			w.Header().Set("Remote-Groups", "")
 		}
 	})
 
@@ -0,0 +1,293 @@
+package obligator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/smtp"
+	"os/exec"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+//go:embed templates/mail
+var mailTemplatesFs embed.FS
+
+const (
+	MailerTypeSmtp     = "smtp"
+	MailerTypeSendmail = "sendmail"
+	MailerTypeNull     = "null"
+)
+
+const (
+	MailTemplateMagicLink     = "magic-link"
+	MailTemplateCode          = "code"
+	MailTemplateWelcome       = "welcome"
+	MailTemplateSecurityAlert = "security-alert"
+)
+
+const defaultMailLocale = "en"
+
+// mailCatalogStrings are the translations looked up by the templates'
+// {{t "key" ...}} calls via golang.org/x/text/message. Keyed by message id,
+// valued by a Sprintf-style format string.
+var mailCatalogStrings = map[string]string{
+	"mail.magic_link.subject":     "Sign in to %[1]s",
+	"mail.magic_link.body":        "Click the link below to sign in to %[1]s.",
+	"mail.code.subject":           "Your %[1]s sign-in code",
+	"mail.code.body":              "Enter this code to sign in to %[1]s:",
+	"mail.welcome.subject":        "Welcome to %[1]s",
+	"mail.welcome.body":           "Your account on %[1]s is ready to go.",
+	"mail.security_alert.subject": "Security alert for %[1]s",
+	"mail.security_alert.body":    "We noticed a new sign-in to your %[1]s account: %[2]s.",
+	"mail.footer.ignore":          "If you didn't request this, you can safely ignore this email.",
+}
+
+func init() {
+	for key, msg := range mailCatalogStrings {
+		err := message.SetString(language.English, key, msg)
+		if err != nil {
+			panic(fmt.Sprintf("mailer: invalid catalog message %q: %v", key, err))
+		}
+	}
+}
+
+// Mailer abstracts how obligator delivers transactional email (magic
+// links, codes, welcome mail, security alerts); newMailer picks the SMTP,
+// sendmail, or null implementation named by ServerConfig.MailerType.
+type Mailer interface {
+	Send(ctx context.Context, to string, tmplName string, locale string, data any) error
+}
+
+func newMailer(mailerType string, smtpConf *SmtpConfig) (Mailer, error) {
+	switch mailerType {
+	case "", MailerTypeSmtp:
+		return NewSmtpMailer(smtpConf), nil
+	case MailerTypeSendmail:
+		return NewSendmailMailer(), nil
+	case MailerTypeNull:
+		return NewNullMailer(), nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown MailerType %q", mailerType)
+	}
+}
+
+type renderedMail struct {
+	subject  string
+	textBody string
+	htmlBody string
+}
+
+// renderMail renders the subject/text/html templates for tmplName in the
+// given locale, falling back to the default locale's templates when a
+// translated copy isn't available.
+func renderMail(tmplName string, locale string, data any) (*renderedMail, error) {
+
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.English
+	}
+
+	p := message.NewPrinter(tag)
+
+	funcMap := map[string]interface{}{
+		"t": func(key string, a ...interface{}) string {
+			return p.Sprintf(key, a...)
+		},
+	}
+
+	localeTag := tag.String()
+
+	render := func(kind string) (string, error) {
+		path := fmt.Sprintf("templates/mail/%s.%s.%s.tmpl", tmplName, kind, localeTag)
+		content, err := mailTemplatesFs.ReadFile(path)
+		if err != nil {
+			// Fall back to the default locale if this one isn't translated.
+			path = fmt.Sprintf("templates/mail/%s.%s.%s.tmpl", tmplName, kind, defaultMailLocale)
+			content, err = mailTemplatesFs.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("mailer: no %s template for %s: %w", kind, tmplName, err)
+			}
+		}
+
+		var buf bytes.Buffer
+
+		// body.html is rendered into an HTML email, so it goes through
+		// html/template for contextual escaping; subject and body.txt are
+		// plain text, so text/template is enough for them.
+		if kind == "body.html" {
+			t, err := htmltemplate.New(path).Funcs(htmltemplate.FuncMap(funcMap)).Parse(string(content))
+			if err != nil {
+				return "", err
+			}
+
+			if err := t.Execute(&buf, data); err != nil {
+				return "", err
+			}
+		} else {
+			t, err := texttemplate.New(path).Funcs(texttemplate.FuncMap(funcMap)).Parse(string(content))
+			if err != nil {
+				return "", err
+			}
+
+			if err := t.Execute(&buf, data); err != nil {
+				return "", err
+			}
+		}
+
+		return buf.String(), nil
+	}
+
+	subject, err := render("subject")
+	if err != nil {
+		return nil, err
+	}
+
+	textBody, err := render("body.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody, err := render("body.html")
+	if err != nil {
+		return nil, err
+	}
+
+	return &renderedMail{
+		subject:  subject,
+		textBody: textBody,
+		htmlBody: htmlBody,
+	}, nil
+}
+
+// SmtpMailer is the original mailer behavior: send directly over SMTP
+// using the configured SmtpConfig.
+type SmtpMailer struct {
+	conf *SmtpConfig
+}
+
+func NewSmtpMailer(conf *SmtpConfig) *SmtpMailer {
+	return &SmtpMailer{conf: conf}
+}
+
+func (m *SmtpMailer) Send(ctx context.Context, to string, tmplName string, locale string, data any) error {
+
+	if m.conf == nil {
+		return fmt.Errorf("mailer: no SMTP config set")
+	}
+
+	mail, err := renderMail(tmplName, locale, data)
+	if err != nil {
+		return err
+	}
+
+	from := m.conf.Sender
+	if m.conf.SenderName != "" {
+		from = fmt.Sprintf("%s <%s>", m.conf.SenderName, m.conf.Sender)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n%s",
+		from, to, mail.subject, mail.htmlBody)
+
+	addr := fmt.Sprintf("%s:%d", m.conf.Server, m.conf.Port)
+	auth := smtp.PlainAuth("", m.conf.Username, m.conf.Password, m.conf.Server)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.StartTLS(&tls.Config{ServerName: m.conf.Server})
+	if err != nil {
+		return err
+	}
+
+	err = client.Auth(auth)
+	if err != nil {
+		return err
+	}
+
+	err = client.Mail(m.conf.Sender)
+	if err != nil {
+		return err
+	}
+
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = w.Write([]byte(msg))
+	return err
+}
+
+// SendmailMailer shells out to the local MTA's sendmail binary, for
+// deployments that'd rather rely on Postfix/Exim than talk SMTP directly.
+type SendmailMailer struct{}
+
+func NewSendmailMailer() *SendmailMailer {
+	return &SendmailMailer{}
+}
+
+func (m *SendmailMailer) Send(ctx context.Context, to string, tmplName string, locale string, data any) error {
+
+	mail, err := renderMail(tmplName, locale, data)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n%s",
+		to, mail.subject, mail.htmlBody)
+
+	cmd := exec.CommandContext(ctx, "sendmail", "-t")
+	cmd.Stdin = bytes.NewBufferString(msg)
+
+	return cmd.Run()
+}
+
+// NullMailer logs the rendered mail instead of sending it. Useful for
+// tests and local development.
+type NullMailer struct{}
+
+func NewNullMailer() *NullMailer {
+	return &NullMailer{}
+}
+
+func (m *NullMailer) Send(ctx context.Context, to string, tmplName string, locale string, data any) error {
+	mail, err := renderMail(tmplName, locale, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(fmt.Sprintf("NullMailer: to=%s template=%s subject=%q", to, tmplName, mail.subject))
+	return nil
+}
+
+// localeFromAcceptLanguage returns the highest-weighted locale tag string of
+// an Accept-Language header value, or the default locale when the header is
+// empty or unparseable. The tag is not checked against the available
+// templates; renderMail falls back to the default locale for those.
+func localeFromAcceptLanguage(acceptLanguage string) string {
+	if acceptLanguage == "" {
+		return defaultMailLocale
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return defaultMailLocale
+	}
+
+	return tags[0].String()
+}
@@ -0,0 +1,104 @@
+package obligator
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry is obligator's own Prometheus registry, rather than the
+// global default one, so embedders who already run their own /metrics
+// endpoint can mount this one separately instead of colliding with it.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "obligator_http_requests_total",
+		Help: "Total HTTP requests, by handler and status class (2xx, 3xx, 4xx, 5xx).",
+	}, []string{"handler", "status"})
+
+	forwardAuthDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "obligator_forward_auth_decisions_total",
+		Help: "Forward-auth decisions, by outcome (allow, deny, passthrough).",
+	}, []string{"decision"})
+
+	tokenIssuanceTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "obligator_token_issuance_total",
+		Help: "OAuth2/OIDC tokens issued at /token, by grant type.",
+	}, []string{"grant_type"})
+
+	emailMagicLinkSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "obligator_email_magic_link_sent_total",
+		Help: "Magic-link emails sent.",
+	})
+
+	emailRateLimitRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "obligator_email_rate_limit_rejected_total",
+		Help: "Magic-link email sends rejected for exceeding the rate limit.",
+	})
+
+	oauth2ExchangeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "obligator_oauth2_exchange_duration_seconds",
+		Help: "Latency of exchanging an authorization code with an upstream OAuth2 provider.",
+	}, []string{"provider"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequestsTotal,
+		forwardAuthDecisionsTotal,
+		tokenIssuanceTotal,
+		emailMagicLinkSentTotal,
+		emailRateLimitRejectedTotal,
+		oauth2ExchangeDuration,
+	)
+}
+
+func RecordHttpRequest(handler string, status int) {
+	httpRequestsTotal.WithLabelValues(handler, statusLabel(status)).Inc()
+}
+
+const (
+	ForwardAuthAllow       = "allow"
+	ForwardAuthDeny        = "deny"
+	ForwardAuthPassthrough = "passthrough"
+)
+
+func RecordForwardAuthDecision(decision string) {
+	forwardAuthDecisionsTotal.WithLabelValues(decision).Inc()
+}
+
+func RecordTokenIssuance(grantType string) {
+	tokenIssuanceTotal.WithLabelValues(grantType).Inc()
+}
+
+func RecordEmailMagicLinkSent() {
+	emailMagicLinkSentTotal.Inc()
+}
+
+func RecordEmailRateLimitRejected() {
+	emailRateLimitRejectedTotal.Inc()
+}
+
+func RecordOAuth2ExchangeDuration(provider string, d time.Duration) {
+	oauth2ExchangeDuration.WithLabelValues(provider).Observe(d.Seconds())
+}
+
+func statusLabel(status int) string {
+	switch {
+	case status >= 500:
+		return "5xx"
+	case status >= 400:
+		return "4xx"
+	case status >= 300:
+		return "3xx"
+	default:
+		return "2xx"
+	}
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
@@ -10,9 +10,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ip2location/ip2location-go/v9"
+	"github.com/nbeirne/obligator/clientstore"
+	"github.com/nbeirne/obligator/providers"
 )
 
 const IdentityTypeEmail = "email"
@@ -34,12 +37,18 @@ type Login struct {
 }
 
 type Server struct {
-	api    *Api
-	Config ServerConfig
-	Mux    *ObligatorMux
-	db     Database
-	jose   *JOSE
-	muxMap map[string]http.Handler
+	api               *Api
+	Config            ServerConfig
+	Mux               *ObligatorMux
+	db                Database
+	jose              *JOSE
+	muxMap            map[string]http.Handler
+	extraJwtIssuerMan *ExtraJwtIssuerManager
+	delivery          Delivery
+	clientStore       *clientstore.Store
+	mailer            Mailer
+	tmpl              *template.Template
+	logger            Logger
 }
 
 type ServerConfig struct {
@@ -63,6 +72,35 @@ type ServerConfig struct {
 	JwksJson               string
 	OAuth2Providers        []*OAuth2Provider `json:"oauth2_providers"`
 	Smtp                   *SmtpConfig       `json:"smtp"`
+	// ExtraJwtIssuers lets forward-auth requests authenticate with an
+	// Authorization: Bearer <jwt> header, verified against these issuers,
+	// instead of the usual login cookie. Intended for non-browser clients
+	// such as CLIs, CI jobs, or other services.
+	ExtraJwtIssuers []JwtIssuerConfig `json:"extra_jwt_issuers"`
+	// Delivery selects the HTTP transport obligator listens with. One of
+	// DeliveryNetHTTP (default) or DeliveryFastHTTP. FastHTTP support must
+	// be compiled in via the `fasthttp` build tag.
+	Delivery string `json:"delivery"`
+	// MailerType selects how magic-link/code/welcome/security-alert mail
+	// is delivered. One of MailerTypeSmtp (default), MailerTypeSendmail,
+	// or MailerTypeNull. Server.SetMailer does not replace the Mailer chosen
+	// here for the email login handlers.
+	MailerType string `json:"mailer_type"`
+	// RoleClaim is the name of the JWT claim (on ExtraJwtIssuers-verified
+	// bearer tokens) holding a caller's groups, surfaced as Validation.Groups
+	// and the Remote-Groups forward-auth header.
+	RoleClaim string `json:"role_claim"`
+	// Logger receives one RequestLogRecord per request in place of the
+	// default SlogLogger. Leave nil to use the default.
+	Logger Logger `json:"-"`
+	// MetricsEnabled mounts a Prometheus /metrics endpoint on the internal
+	// handler set.
+	MetricsEnabled bool `json:"metrics_enabled"`
+	// TotpDigits and TotpPeriod override the RFC 6238 code length and time
+	// step used for TOTP enrollment/verification. Leave zero-valued to use
+	// DefaultTotpDigits/DefaultTotpPeriod.
+	TotpDigits int           `json:"totp_digits"`
+	TotpPeriod time.Duration `json:"totp_period"`
 }
 
 type StringList []string
@@ -108,8 +146,10 @@ type UserinfoResponse struct {
 }
 
 type Validation struct {
-	Id     string `json:"id"`
-	IdType string `json:"id_type"`
+	Id     string   `json:"id"`
+	IdType string   `json:"id_type"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
 }
 
 const RateLimitTime = 24 * time.Hour
@@ -140,27 +180,85 @@ func (s *ObligatorMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	requestId := ensureRequestId(r)
+	w.Header().Set(RequestIdHeader, requestId)
+
 	// TODO: mutex?
 	mux, exists := s.server.muxMap[r.Host]
 	if exists {
-		validation, err := s.server.Validate(r)
+		start := time.Now()
+
+		remoteIp, err := getRemoteIp(r, s.behindProxy)
 		if err != nil {
-			w.WriteHeader(401)
+			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
+		sw := &statusCapturingResponseWriter{ResponseWriter: w, status: 200}
+
+		defer func() {
+			s.server.logger.LogRequest(RequestLogRecord{
+				Method:    r.Method,
+				Host:      r.Host,
+				Path:      r.URL.Path,
+				Status:    sw.status,
+				Duration:  time.Since(start),
+				RemoteIp:  remoteIp,
+				RequestId: requestId,
+			})
+			RecordHttpRequest(r.Host, sw.status)
+		}()
+
+		validation, err := s.server.Validate(r)
+		if err != nil {
+			RecordForwardAuthDecision(ForwardAuthDeny)
+			sw.WriteHeader(401)
+			io.WriteString(sw, err.Error())
+			return
+		}
+
+		var roles, groups []string
+		if validation != nil {
+			roles = validation.Roles
+			groups = validation.Groups
+		}
+
+		reqs, err := s.server.db.GetRoleRequirements(r.Host)
+		if err != nil {
+			sw.WriteHeader(500)
+			io.WriteString(sw, err.Error())
+			return
+		}
+
+		if !matchRoleRequirement(r.Host, r.URL.Path, append(append([]string{}, roles...), groups...), reqs) {
+			RecordForwardAuthDecision(ForwardAuthDeny)
+			writeForbidden(sw, r, s.server.tmpl, s.server.db)
+			return
+		}
+
+		if validation == nil {
+			RecordForwardAuthDecision(ForwardAuthPassthrough)
+		} else {
+			RecordForwardAuthDecision(ForwardAuthAllow)
+		}
+
 		newReq := r.Clone(context.Background())
+		newReq.Header.Set(RequestIdHeader, requestId)
 
 		if validation != nil {
 			newReq.Header.Set("Remote-Id-Type", validation.IdType)
 			newReq.Header.Set("Remote-Id", validation.Id)
+			newReq.Header.Set("Remote-Roles", strings.Join(validation.Roles, ","))
+			newReq.Header.Set("Remote-Groups", strings.Join(validation.Groups, ","))
 		} else {
 			newReq.Header.Set("Remote-Id-Type", "")
 			newReq.Header.Set("Remote-Id", "")
+			newReq.Header.Set("Remote-Roles", "")
+			newReq.Header.Set("Remote-Groups", "")
 		}
 
-		mux.ServeHTTP(w, newReq)
+		mux.ServeHTTP(sw, newReq)
 		return
 	}
 
@@ -169,7 +267,7 @@ func (s *ObligatorMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
 	w.Header().Set("Referrer-Policy", "no-referrer")
 
-	timestamp := time.Now().Format(time.RFC3339)
+	start := time.Now()
 
 	remoteIp, err := getRemoteIp(r, s.behindProxy)
 	if err != nil {
@@ -197,8 +295,20 @@ func (s *ObligatorMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	http.SetCookie(w, crossSiteDetectorCookie)
 
-	fmt.Println(fmt.Sprintf("%s\t%s\t%s\t%s\t%s", timestamp, remoteIp, r.Method, r.Host, r.URL.Path))
-	s.mux.ServeHTTP(w, r)
+	sw := &statusCapturingResponseWriter{ResponseWriter: w, status: 200}
+	s.mux.ServeHTTP(sw, r)
+
+	s.server.logger.LogRequest(RequestLogRecord{
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Status:    sw.status,
+		Duration:  time.Since(start),
+		RemoteIp:  remoteIp,
+		RequestId: requestId,
+	})
+	_, routePattern := s.mux.Handler(r)
+	RecordHttpRequest(routePattern, sw.status)
 }
 
 func (s *ObligatorMux) Handle(p string, h http.Handler) {
@@ -338,12 +448,26 @@ func NewServer(conf ServerConfig) *Server {
 	jose, err := NewJOSE(db, cluster)
 	checkErr(err)
 
-	tmpl, err := template.ParseFS(fs, "templates/*")
+	var extraJwtIssuerMan *ExtraJwtIssuerManager
+	if len(conf.ExtraJwtIssuers) > 0 {
+		extraJwtIssuerMan, err = NewExtraJwtIssuerManager(conf.ExtraJwtIssuers, conf.RoleClaim)
+		checkErr(err)
+	}
+
+	// templates/mail holds its own subject/body templates (rendered
+	// separately by the Mailer, with per-locale i18n), so it's excluded
+	// from this glob by matching only the page templates directly under
+	// templates/.
+	tmpl, err := template.ParseFS(fs, "templates/*.html")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
+	var mailer Mailer
+	mailer, err = newMailer(conf.MailerType, conf.Smtp)
+	checkErr(err)
+
 	mux := NewObligatorMux(conf.BehindProxy)
 
 	var geoDb *ip2location.DB
@@ -355,24 +479,48 @@ func NewServer(conf ServerConfig) *Server {
 		}
 	}
 
-	handler := NewHandler(db, conf, tmpl, jose)
+	handler := NewHandler(db, conf, tmpl, jose, extraJwtIssuerMan)
 	mux.Handle("/", handler)
 
-	oidcHandler := NewOIDCHandler(db, conf, tmpl, jose)
+	clientStore := clientstore.NewStore(db)
+
+	oidcHandler := NewOIDCHandler(db, conf, tmpl, jose, clientStore)
 	mux.Handle("/.well-known/openid-configuration", oidcHandler)
 	mux.Handle("/jwks", oidcHandler)
-	mux.Handle("/register", oidcHandler)
 	mux.Handle("/userinfo", oidcHandler)
 	mux.Handle("/auth", oidcHandler)
 	mux.Handle("/approve", oidcHandler)
 	mux.Handle("/token", oidcHandler)
 	mux.Handle("/end-session", oidcHandler)
 
-	addIdentityOauth2Handler := NewAddIdentityOauth2Handler(db, oauth2MetaMan, jose)
+	// Dynamic client registration (RFC 7591) replaces the old oidcHandler
+	// stub at /register now that clients are persisted in clientStore.
+	clientRegistrationHandler := NewClientRegistrationHandler(clientStore)
+	mux.Handle("/register", clientRegistrationHandler)
+
+	adminClientsHandler := NewAdminClientsHandler(db, clientStore, jose)
+	mux.Handle("/admin/clients", adminClientsHandler)
+	mux.Handle("/admin/clients/", adminClientsHandler)
+
+	totp2faHandler := NewTotp2FAHandler(db, tmpl, jose, conf.TotpDigits, conf.TotpPeriod)
+	mux.Handle("/2fa/enroll", totp2faHandler)
+	mux.Handle("/2fa/verify", totp2faHandler)
+	mux.Handle("/2fa/disable", totp2faHandler)
+	mux.Handle("/2fa/recovery-codes", totp2faHandler)
+
+	rolesHandler := NewRolesHandler(db, jose)
+	mux.Handle("/roles", rolesHandler)
+	mux.Handle("/assign-role", rolesHandler)
+
+	// providers.New resolves an OAuth2Provider.Type to a pre-built profile
+	// (Google, GitHub, GitLab, Keycloak, Bitbucket, Mastodon, login.gov),
+	// falling back to the generic OIDC-discovery-based provider for an
+	// unset or unrecognized Type so existing configs keep working.
+	addIdentityOauth2Handler := NewAddIdentityOauth2Handler(db, oauth2MetaMan, jose, providers.New)
 	mux.Handle("/login-oauth2", addIdentityOauth2Handler)
 	mux.Handle("/callback", addIdentityOauth2Handler)
 
-	addIdentityEmailHandler := NewAddIdentityEmailHandler(db, cluster, tmpl, conf.BehindProxy, geoDb, jose)
+	addIdentityEmailHandler := NewAddIdentityEmailHandler(db, cluster, tmpl, conf.BehindProxy, geoDb, jose, mailer)
 	mux.Handle("/login-email", addIdentityEmailHandler)
 	mux.Handle("/email-sent", addIdentityEmailHandler)
 	mux.Handle("/magic", addIdentityEmailHandler)
@@ -409,13 +557,23 @@ func NewServer(conf ServerConfig) *Server {
 	mux.Handle("/login-fedcm", addIdentityFedCmHandler)
 	mux.Handle("/complete-login-fedcm", addIdentityFedCmHandler)
 
+	if conf.MetricsEnabled {
+		mux.Handle("/metrics", metricsHandler())
+	}
+
 	s := &Server{
-		Config: conf,
-		Mux:    mux,
-		api:    api,
-		db:     db,
-		jose:   jose,
-		muxMap: make(map[string]http.Handler),
+		Config:            conf,
+		Mux:               mux,
+		api:               api,
+		db:                db,
+		jose:              jose,
+		muxMap:            make(map[string]http.Handler),
+		extraJwtIssuerMan: extraJwtIssuerMan,
+		delivery:          newDelivery(conf.Delivery),
+		clientStore:       clientStore,
+		mailer:            mailer,
+		tmpl:              tmpl,
+		logger:            newLogger(conf.Logger),
 	}
 
 	// TODO: very hacky
@@ -430,14 +588,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) Start() error {
 
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", s.Config.Port),
-		Handler: s.Mux,
-	}
+	s.delivery.Register("/", s.Mux.ServeHTTP)
 
 	fmt.Println("Running")
 
-	err := server.ListenAndServe()
+	err := s.delivery.Start(fmt.Sprintf(":%d", s.Config.Port))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		return err
@@ -446,6 +601,10 @@ func (s *Server) Start() error {
 	return nil
 }
 
+func (s *Server) Stop(ctx context.Context) error {
+	return s.delivery.Stop(ctx)
+}
+
 // TODO: re-enable
 //func (s *Server) AuthUri(authReq *OAuth2AuthRequest) string {
 //	return AuthUri(s.Config.RootUri+"/auth", authReq)
@@ -471,12 +630,54 @@ func (s *Server) AddUser(user User) error {
 	return s.api.AddUser(user)
 }
 
+func (s *Server) RegisterClient(reg clientstore.ClientRegistration) (*clientstore.RegisteredClient, error) {
+	return s.clientStore.Register(reg)
+}
+
+func (s *Server) GetClient(id string) (*clientstore.Client, error) {
+	return s.clientStore.Get(id)
+}
+
+// EnableTOTP generates and stores a TOTP secret for userId (in the form
+// "<id_type>:<id>", matching Validation.IdType/Id), for embedders that want
+// to force-enroll a user in 2FA out of band rather than sending them
+// through /2fa/enroll. The secret is returned once so it can be delivered
+// to the user.
+func (s *Server) EnableTOTP(userId string) (string, error) {
+	secret, err := GenerateTotpSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.SetTotpSecret(userId, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// SetRoleRequirement gates domain/pathPrefix behind role, so e.g. /admin on
+// an upstream can require the "admin" role without the upstream app having
+// to know anything about roles itself.
+func (s *Server) SetRoleRequirement(domain, pathPrefix, role string) error {
+	return s.db.SetRoleRequirement(domain, pathPrefix, role)
+}
+
+// SetMailer stores mailer on the Server. The email login handlers built by
+// NewServer are handed the MailerType-selected Mailer at construction time
+// and keep sending through it; SetMailer does not change which Mailer they
+// use.
+func (s *Server) SetMailer(mailer Mailer) {
+	s.mailer = mailer
+}
+
 func (s *Server) GetUsers() ([]*User, error) {
 	return s.api.GetUsers()
 }
 
 func (s *Server) Validate(r *http.Request) (*Validation, error) {
-	return validate(s.db, r, s.jose)
+	return validate(s.db, r, s.jose, s.extraJwtIssuerMan)
 }
 
 func (s *Server) ProxyMux(domain string, mux http.Handler) error {
@@ -492,31 +693,72 @@ func checkErrPassthrough(err error, passthrough bool) (*Validation, error) {
 	}
 }
 
-func validate(db Database, r *http.Request, jose *JOSE) (*Validation, error) {
+func validate(db Database, r *http.Request, jose *JOSE, extraJwtIssuerMan *ExtraJwtIssuerManager) (*Validation, error) {
 
-	passthrough, err := db.GetForwardAuthPassthrough()
+	if bearerTok := bearerTokenFromRequest(r); bearerTok != "" && extraJwtIssuerMan != nil {
+		return extraJwtIssuerMan.Validate(bearerTok)
+	}
+
+	v, twoFaPassed, err := validateLoginCookie(db, r, jose)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		// Passthrough is enabled and there's no usable login cookie; no
+		// identity to check TOTP enrollment against.
+		return nil, nil
+	}
+
+	totpSecret, err := db.GetTotpSecret(totpIdentId(v.IdType, v.Id))
 	if err != nil {
 		return nil, err
 	}
 
+	if totpSecret != "" && !twoFaPassed {
+		return nil, ErrTotpRequired
+	}
+
+	return v, nil
+}
+
+// validateIgnoringTotp behaves like validate, but never gates on TOTP. It
+// backs the /2fa/* endpoints themselves, which must stay reachable by a
+// user who hasn't completed 2FA yet.
+func validateIgnoringTotp(db Database, r *http.Request, jose *JOSE) (*Validation, error) {
+	v, _, err := validateLoginCookie(db, r, jose)
+	return v, err
+}
+
+func validateLoginCookie(db Database, r *http.Request, jose *JOSE) (*Validation, bool, error) {
+
+	passthrough, err := db.GetForwardAuthPassthrough()
+	if err != nil {
+		return nil, false, err
+	}
+
 	loginKeyCookie, err := getLoginCookie(db, r)
 	if err != nil {
-		return checkErrPassthrough(err, passthrough)
+		v, e := checkErrPassthrough(err, passthrough)
+		return v, false, e
 	}
 
 	parsed, err := jose.Parse(loginKeyCookie.Value)
 	if err != nil {
-		return checkErrPassthrough(err, passthrough)
+		v, e := checkErrPassthrough(err, passthrough)
+		return v, false, e
 	}
 
 	tokIdentsInterface, exists := parsed.Get("identities")
 	if !exists {
-		return checkErrPassthrough(errors.New("No identities"), passthrough)
+		v, e := checkErrPassthrough(errors.New("No identities"), passthrough)
+		return v, false, e
 	}
 
 	tokIdents, ok := tokIdentsInterface.([]*Identity)
 	if !ok {
-		return checkErrPassthrough(errors.New("No identities"), passthrough)
+		v, e := checkErrPassthrough(errors.New("No identities"), passthrough)
+		return v, false, e
 	}
 
 	// TODO: maybe return whole list of identities?
@@ -527,7 +769,20 @@ func validate(db Database, r *http.Request, jose *JOSE) (*Validation, error) {
 		Id:     ident.Id,
 	}
 
-	return v, nil
+	roles, err := db.GetUserRoles(totpIdentId(v.IdType, v.Id))
+	if err != nil {
+		return nil, false, err
+	}
+	v.Roles = roles
+
+	twoFaPassed := false
+	if passedInterface, exists := parsed.Get("2fa_passed"); exists {
+		if passedBool, ok := passedInterface.(bool); ok {
+			twoFaPassed = passedBool
+		}
+	}
+
+	return v, twoFaPassed, nil
 }
 
 func checkErr(err error) {
@@ -0,0 +1,481 @@
+package obligator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbeirne/obligator/clientstore"
+)
+
+// AuthCode is a single-use authorization code minted by /auth (or /approve,
+// once the user has consented) and redeemed by /token.
+type AuthCode struct {
+	Code                string
+	ClientId            string
+	RedirectUri         string
+	Scopes              []string
+	IdentId             string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+}
+
+const authCodeLifetime = 2 * time.Minute
+
+// OIDCHandler serves the OpenID Connect / OAuth2 authorization-server
+// surface: discovery, jwks, userinfo, and the /auth, /approve, and /token
+// endpoints that make up the authorization_code flow. /token is where
+// third-party clients are actually authenticated (client_secret_basic,
+// client_secret_post, or none+PKCE for public clients) and where the
+// requested redirect_uri and scopes are checked against clientStore,
+// rather than trusting whatever the authorization request claimed.
+type OIDCHandler struct {
+	mux *http.ServeMux
+}
+
+func NewOIDCHandler(db Database, conf ServerConfig, tmpl *template.Template, jose *JOSE, clientStore *clientstore.Store) *OIDCHandler {
+
+	mux := http.NewServeMux()
+	h := &OIDCHandler{mux: mux}
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := domainToUri(r.Host)
+
+		writeJson(w, map[string]interface{}{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/auth",
+			"token_endpoint":                        issuer + "/token",
+			"userinfo_endpoint":                     issuer + "/userinfo",
+			"jwks_uri":                              issuer + "/jwks",
+			"end_session_endpoint":                  issuer + "/end-session",
+			"registration_endpoint":                 issuer + "/register",
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwks, err := jose.JWKS()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		tok := bearerTokenFromRequest(r)
+		if tok == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		parsed, err := jose.Parse(tok)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		sub, _ := parsed.Get("sub")
+		email, _ := parsed.Get("email")
+
+		writeJson(w, UserinfoResponse{
+			Sub:   fmt.Sprint(sub),
+			Email: fmt.Sprint(email),
+		})
+	})
+
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		handleAuth(w, r, db, tmpl, jose, clientStore)
+	})
+
+	mux.HandleFunc("/approve", func(w http.ResponseWriter, r *http.Request) {
+		handleApprove(w, r, db, jose, clientStore)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		handleToken(w, r, db, jose, clientStore)
+	})
+
+	mux.HandleFunc("/end-session", func(w http.ResponseWriter, r *http.Request) {
+		cookieDomain, err := buildCookieDomain(r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Domain:   cookieDomain,
+			Name:     conf.Prefix + "login_key",
+			Value:    "",
+			Secure:   true,
+			HttpOnly: true,
+			MaxAge:   -1,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		redirUri := r.URL.Query().Get("post_logout_redirect_uri")
+		if redirUri != "" {
+			http.Redirect(w, r, redirUri, http.StatusSeeOther)
+		}
+	})
+
+	return h
+}
+
+func (h *OIDCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// authRequestParams is the validated, client-checked form of an
+// authorization request, shared by /auth and /approve.
+type authRequestParams struct {
+	Client              *clientstore.Client
+	RedirectUri         string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func parseAuthRequest(r *http.Request, clientStore *clientstore.Store) (*authRequestParams, error) {
+
+	q := r.URL.Query()
+
+	client, err := clientStore.Get(q.Get("client_id"))
+	if err != nil {
+		return nil, clientstore.ErrClientNotFound
+	}
+
+	redirectUri := q.Get("redirect_uri")
+	if err := clientStore.ValidateRedirectUri(client, redirectUri); err != nil {
+		return nil, err
+	}
+
+	requested := strings.Fields(q.Get("scope"))
+	granted := clientStore.ValidateScopes(client, requested)
+
+	codeChallenge := q.Get("code_challenge")
+	codeChallengeMethod := q.Get("code_challenge_method")
+
+	if client.Public {
+		// Public clients have no secret, so PKCE is how they prove
+		// possession of the auth code at /token (RFC 8252).
+		if codeChallenge == "" {
+			return nil, errors.New("oidc: code_challenge is required for public clients")
+		}
+
+		if codeChallengeMethod != "S256" {
+			return nil, errors.New("oidc: code_challenge_method must be S256 for public clients")
+		}
+	}
+
+	return &authRequestParams{
+		Client:              client,
+		RedirectUri:         redirectUri,
+		Scopes:              granted,
+		State:               q.Get("state"),
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+	}, nil
+}
+
+func handleAuth(w http.ResponseWriter, r *http.Request, db Database, tmpl *template.Template, jose *JOSE, clientStore *clientstore.Store) {
+
+	params, err := parseAuthRequest(r, clientStore)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	validation, err := validate(db, r, jose, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if validation == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "login required")
+		return
+	}
+
+	identId := totpIdentId(validation.IdType, validation.Id)
+
+	hasConsent, err := clientStore.HasConsent(identId, params.Client.Id, params.Scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if !hasConsent {
+		data := struct {
+			*commonData
+			Client *clientstore.Client
+			Scopes []string
+			Query  string
+		}{
+			commonData: newCommonData(nil, db, r),
+			Client:     params.Client,
+			Scopes:     params.Scopes,
+			Query:      r.URL.RawQuery,
+		}
+
+		err = tmpl.ExecuteTemplate(w, "approve.html", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+		}
+
+		return
+	}
+
+	issueAuthCode(w, r, db, identId, params)
+}
+
+func handleApprove(w http.ResponseWriter, r *http.Request, db Database, jose *JOSE, clientStore *clientstore.Store) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+
+	params, err := parseAuthRequest(r, clientStore)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	validation, err := validate(db, r, jose, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if validation == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "login required")
+		return
+	}
+
+	identId := totpIdentId(validation.IdType, validation.Id)
+
+	err = clientStore.RecordConsent(identId, params.Client.Id, params.Scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	issueAuthCode(w, r, db, identId, params)
+}
+
+func issueAuthCode(w http.ResponseWriter, r *http.Request, db Database, identId string, params *authRequestParams) {
+
+	code, err := randomUrlSafeToken(32)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	err = db.CreateAuthCode(&AuthCode{
+		Code:                code,
+		ClientId:            params.Client.Id,
+		RedirectUri:         params.RedirectUri,
+		Scopes:              params.Scopes,
+		IdentId:             identId,
+		CodeChallenge:       params.CodeChallenge,
+		CodeChallengeMethod: params.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(authCodeLifetime),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	redirUri, err := url.Parse(params.RedirectUri)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	q := redirUri.Query()
+	q.Set("code", code)
+	if params.State != "" {
+		q.Set("state", params.State)
+	}
+	redirUri.RawQuery = q.Encode()
+
+	http.Redirect(w, r, redirUri.String(), http.StatusSeeOther)
+}
+
+// authenticateTokenClient implements client_secret_basic, client_secret_post,
+// and none (public client + PKCE) authentication for /token, per RFC 6749
+// section 2.3 and RFC 7636.
+func authenticateTokenClient(r *http.Request, clientStore *clientstore.Store) (*clientstore.Client, error) {
+
+	if id, secret, ok := r.BasicAuth(); ok {
+		return clientStore.Authenticate(id, secret)
+	}
+
+	id := r.Form.Get("client_id")
+	if id == "" {
+		return nil, errors.New("oidc: client_id is required")
+	}
+
+	client, err := clientStore.Get(id)
+	if err != nil {
+		return nil, clientstore.ErrClientNotFound
+	}
+
+	if client.Public {
+		// Public clients have no secret; they prove themselves via PKCE
+		// (checked against the stored auth code) instead.
+		return client, nil
+	}
+
+	return clientStore.Authenticate(id, r.Form.Get("client_secret"))
+}
+
+func verifyPkce(code *AuthCode, verifier string) bool {
+	if code.CodeChallenge == "" {
+		return true
+	}
+
+	if verifier == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return computed == code.CodeChallenge
+}
+
+func handleToken(w http.ResponseWriter, r *http.Request, db Database, jose *JOSE, clientStore *clientstore.Store) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+
+	grantType := r.Form.Get("grant_type")
+	if grantType != "authorization_code" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "unsupported_grant_type")
+		return
+	}
+
+	client, err := authenticateTokenClient(r, clientStore)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	codeParam := r.Form.Get("code")
+	code, err := db.GetAuthCode(codeParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "invalid_grant")
+		return
+	}
+
+	// The auth code is single-use regardless of what happens below, so a
+	// leaked/replayed code can't be redeemed twice.
+	db.DeleteAuthCode(codeParam)
+
+	if code.ClientId != client.Id ||
+		code.RedirectUri != r.Form.Get("redirect_uri") ||
+		time.Now().After(code.ExpiresAt) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "invalid_grant")
+		return
+	}
+
+	if !verifyPkce(code, r.Form.Get("code_verifier")) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "invalid_grant")
+		return
+	}
+
+	issuer := domainToUri(r.Host)
+	now := time.Now()
+
+	accessToken, err := jose.NewJWT(map[string]interface{}{
+		"iss":   issuer,
+		"sub":   code.IdentId,
+		"aud":   client.Id,
+		"scope": strings.Join(code.Scopes, " "),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	idToken, err := jose.NewJWT(map[string]interface{}{
+		"iss": issuer,
+		"sub": code.IdentId,
+		"aud": client.Id,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	RecordTokenIssuance(grantType)
+
+	writeJson(w, OAuth2TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   3600,
+		IdToken:     idToken,
+	})
+}
+
+func randomUrlSafeToken(numBytes int) (string, error) {
+	b := make([]byte, numBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,79 @@
+package providers
+
+import "context"
+
+const bitbucketAuthUri = "https://bitbucket.org/site/oauth2/authorize"
+const bitbucketTokenUri = "https://bitbucket.org/site/oauth2/access_token"
+const bitbucketUserUri = "https://api.bitbucket.org/2.0/user"
+const bitbucketEmailsUri = "https://api.bitbucket.org/2.0/user/emails"
+
+// BitbucketProvider is a pre-built profile for Bitbucket Cloud's OAuth2
+// consumers.
+type BitbucketProvider struct {
+	conf Config
+}
+
+func NewBitbucketProvider(conf Config) *BitbucketProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"account", "email"}
+	}
+	return &BitbucketProvider{conf: conf}
+}
+
+func (p *BitbucketProvider) Type() string { return "bitbucket" }
+
+func (p *BitbucketProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(bitbucketAuthUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *BitbucketProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, bitbucketTokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type bitbucketUser struct {
+	AccountId   string `json:"account_id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+type bitbucketEmailsResponse struct {
+	Values []struct {
+		Email       string `json:"email"`
+		IsPrimary   bool   `json:"is_primary"`
+		IsConfirmed bool   `json:"is_confirmed"`
+	} `json:"values"`
+}
+
+func (p *BitbucketProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u bitbucketUser
+	err := fetchJson(ctx, bitbucketUserUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	var emailsRes bitbucketEmailsResponse
+	err = fetchJson(ctx, bitbucketEmailsUri, token.AccessToken, &emailsRes)
+	if err != nil {
+		return nil, err
+	}
+
+	var email string
+	var verified bool
+	for _, e := range emailsRes.Values {
+		if !e.IsConfirmed {
+			continue
+		}
+		if email == "" || e.IsPrimary {
+			email = e.Email
+			verified = true
+		}
+	}
+
+	return &Identity{
+		Id:            u.AccountId,
+		Name:          firstNonEmpty(u.DisplayName, u.Username),
+		Email:         email,
+		EmailVerified: verified,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"context"
+	"strconv"
+)
+
+const githubAuthUri = "https://github.com/login/oauth/authorize"
+const githubTokenUri = "https://github.com/login/oauth/access_token"
+const githubUserUri = "https://api.github.com/user"
+const githubUserEmailsUri = "https://api.github.com/user/emails"
+
+// GitHubProvider is a pre-built profile for GitHub's OAuth2 apps. GitHub's
+// /user endpoint can return an unverified or even empty email, so this
+// profile additionally calls /user/emails and only trusts emails marked
+// verified: true.
+type GitHubProvider struct {
+	conf Config
+}
+
+func NewGitHubProvider(conf Config) *GitHubProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"read:user", "user:email"}
+	}
+	return &GitHubProvider{conf: conf}
+}
+
+func (p *GitHubProvider) Type() string { return "github" }
+
+func (p *GitHubProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(githubAuthUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *GitHubProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, githubTokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type githubUser struct {
+	Id    int    `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func (p *GitHubProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u githubUser
+	err := fetchJson(ctx, githubUserUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []githubEmail
+	err = fetchJson(ctx, githubUserEmailsUri, token.AccessToken, &emails)
+	if err != nil {
+		return nil, err
+	}
+
+	// Crucially, only trust an email GitHub itself has verified. Prefer
+	// the primary verified email, falling back to any other verified one.
+	var email string
+	var verified bool
+	for _, e := range emails {
+		if !e.Verified {
+			continue
+		}
+		if email == "" || e.Primary {
+			email = e.Email
+			verified = true
+		}
+	}
+
+	return &Identity{
+		Id:            strconv.Itoa(u.Id),
+		Name:          firstNonEmpty(u.Name, u.Login),
+		Email:         email,
+		EmailVerified: verified,
+		ExtraClaims: map[string]string{
+			"login": u.Login,
+		},
+	}, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package providers
+
+import (
+	"context"
+	"strconv"
+)
+
+const gitlabAuthUri = "https://gitlab.com/oauth/authorize"
+const gitlabTokenUri = "https://gitlab.com/oauth/token"
+const gitlabUserUri = "https://gitlab.com/api/v4/user"
+
+// GitLabProvider is a pre-built profile for gitlab.com. Self-hosted
+// GitLab instances can override the endpoints via Config.AuthUri/TokenUri/
+// UserinfoUri.
+type GitLabProvider struct {
+	conf        Config
+	authUri     string
+	tokenUri    string
+	userinfoUri string
+}
+
+func NewGitLabProvider(conf Config) *GitLabProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"read_user"}
+	}
+
+	p := &GitLabProvider{
+		conf:        conf,
+		authUri:     gitlabAuthUri,
+		tokenUri:    gitlabTokenUri,
+		userinfoUri: gitlabUserUri,
+	}
+
+	if conf.AuthUri != "" {
+		p.authUri = conf.AuthUri
+	}
+	if conf.TokenUri != "" {
+		p.tokenUri = conf.TokenUri
+	}
+	if conf.UserinfoUri != "" {
+		p.userinfoUri = conf.UserinfoUri
+	}
+
+	return p
+}
+
+func (p *GitLabProvider) Type() string { return "gitlab" }
+
+func (p *GitLabProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(p.authUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *GitLabProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, p.tokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type gitlabUser struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+}
+
+func (p *GitLabProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u gitlabUser
+	err := fetchJson(ctx, p.userinfoUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Id:            firstNonEmpty(u.Username, strconv.Itoa(u.Id)),
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.Email != "",
+	}, nil
+}
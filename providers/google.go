@@ -0,0 +1,53 @@
+package providers
+
+import "context"
+
+const googleAuthUri = "https://accounts.google.com/o/oauth2/v2/auth"
+const googleTokenUri = "https://oauth2.googleapis.com/token"
+const googleUserinfoUri = "https://openidconnect.googleapis.com/v1/userinfo"
+
+// GoogleProvider is a pre-built profile for Google's OIDC-compatible
+// OAuth2 endpoints, so deployments don't have to hand-configure them.
+type GoogleProvider struct {
+	conf Config
+}
+
+func NewGoogleProvider(conf Config) *GoogleProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &GoogleProvider{conf: conf}
+}
+
+func (p *GoogleProvider) Type() string { return "google" }
+
+func (p *GoogleProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(googleAuthUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *GoogleProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, googleTokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type googleUserinfo struct {
+	Sub           string `json:"sub"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (p *GoogleProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u googleUserinfo
+	err := fetchJson(ctx, googleUserinfoUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Id:            u.Sub,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+	}, nil
+}
@@ -0,0 +1,156 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func buildAuthURL(authUri, clientId, redirectUri, state string, scopes []string, pkce *PKCE) string {
+
+	q := url.Values{}
+	q.Set("client_id", clientId)
+	q.Set("redirect_uri", redirectUri)
+	q.Set("response_type", "code")
+	q.Set("state", state)
+	q.Set("scope", strings.Join(scopes, " "))
+
+	if pkce != nil && pkce.Challenge != "" {
+		q.Set("code_challenge", pkce.Challenge)
+		method := pkce.Method
+		if method == "" {
+			method = "S256"
+		}
+		q.Set("code_challenge_method", method)
+	}
+
+	sep := "?"
+	if strings.Contains(authUri, "?") {
+		sep = "&"
+	}
+
+	return authUri + sep + q.Encode()
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+}
+
+func exchangeCode(ctx context.Context, tokenUri, clientId, clientSecret, redirectUri, code string, pkce *PKCE) (*Token, error) {
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("client_id", clientId)
+	form.Set("client_secret", clientSecret)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("code", code)
+
+	if pkce != nil && pkce.Verifier != "" {
+		form.Set("code_verifier", pkce.Verifier)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("providers: token endpoint %s returned %d", tokenUri, res.StatusCode)
+	}
+
+	var tr tokenResponse
+	err = json.NewDecoder(res.Body).Decode(&tr)
+	if err != nil {
+		return nil, err
+	}
+
+	tok := &Token{
+		AccessToken:  tr.AccessToken,
+		TokenType:    tr.TokenType,
+		RefreshToken: tr.RefreshToken,
+		IdToken:      tr.IdToken,
+	}
+
+	if tr.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	return tok, nil
+}
+
+func fetchJson(ctx context.Context, uri, accessToken string, out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("providers: %s returned %d", uri, res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type oidcDiscoveryDoc struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func fetchDiscovery(ctx context.Context, discoveryUri string) (*oidcDiscoveryDoc, error) {
+
+	var doc oidcDiscoveryDoc
+	err := fetchJsonNoAuth(ctx, discoveryUri, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+func fetchJsonNoAuth(ctx context.Context, uri string, out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("providers: %s returned %d", uri, res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,70 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+)
+
+// KeycloakProvider is a pre-built profile for a Keycloak realm. It derives
+// its endpoints from the realm's own discovery document rather than
+// requiring them to be hand-configured.
+type KeycloakProvider struct {
+	conf        Config
+	authUri     string
+	tokenUri    string
+	userinfoUri string
+}
+
+func NewKeycloakProvider(ctx context.Context, conf Config) (*KeycloakProvider, error) {
+
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	discoveryUri := fmt.Sprintf("%s/realms/%s/.well-known/openid-configuration", conf.ServerUri, conf.Realm)
+
+	doc, err := fetchDiscovery(ctx, discoveryUri)
+	if err != nil {
+		return nil, fmt.Errorf("providers: keycloak discovery for realm %q failed: %w", conf.Realm, err)
+	}
+
+	return &KeycloakProvider{
+		conf:        conf,
+		authUri:     doc.AuthorizationEndpoint,
+		tokenUri:    doc.TokenEndpoint,
+		userinfoUri: doc.UserinfoEndpoint,
+	}, nil
+}
+
+func (p *KeycloakProvider) Type() string { return "keycloak" }
+
+func (p *KeycloakProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(p.authUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *KeycloakProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, p.tokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type keycloakUserinfo struct {
+	Sub           string `json:"sub"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (p *KeycloakProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u keycloakUserinfo
+	err := fetchJson(ctx, p.userinfoUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Id:            u.Sub,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+	}, nil
+}
@@ -0,0 +1,51 @@
+package providers
+
+import "context"
+
+const loginGovAuthUri = "https://secure.login.gov/openid_connect/authorize"
+const loginGovTokenUri = "https://secure.login.gov/api/openid_connect/token"
+const loginGovUserinfoUri = "https://secure.login.gov/api/openid_connect/userinfo"
+
+// LoginGovProvider is a pre-built profile for login.gov, the identity
+// provider used by many US federal government sites.
+type LoginGovProvider struct {
+	conf Config
+}
+
+func NewLoginGovProvider(conf Config) *LoginGovProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email"}
+	}
+	return &LoginGovProvider{conf: conf}
+}
+
+func (p *LoginGovProvider) Type() string { return "login.gov" }
+
+func (p *LoginGovProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(loginGovAuthUri, p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *LoginGovProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, loginGovTokenUri, p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type loginGovUserinfo struct {
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func (p *LoginGovProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var u loginGovUserinfo
+	err := fetchJson(ctx, loginGovUserinfoUri, token.AccessToken, &u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Id:            u.Sub,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+	}, nil
+}
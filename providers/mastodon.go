@@ -0,0 +1,67 @@
+package providers
+
+import (
+	"context"
+	"strings"
+)
+
+// MastodonProvider is a pre-built profile for a single Mastodon instance
+// (Config.InstanceUri, e.g. https://mastodon.social). The account it reads
+// carries no email, so Identity.Email is left empty and EmailVerified is
+// always false; the instance-qualified acct handle is
+// injected into ExtraClaims so callers can tell apart same-named users on
+// different instances.
+type MastodonProvider struct {
+	conf        Config
+	instanceUri string
+}
+
+func NewMastodonProvider(conf Config) *MastodonProvider {
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"read:accounts"}
+	}
+	return &MastodonProvider{
+		conf:        conf,
+		instanceUri: strings.TrimSuffix(conf.InstanceUri, "/"),
+	}
+}
+
+func (p *MastodonProvider) Type() string { return "mastodon" }
+
+func (p *MastodonProvider) AuthURL(state string, pkce *PKCE) string {
+	return buildAuthURL(p.instanceUri+"/oauth/authorize", p.conf.ClientId, p.conf.RedirectUri, state, p.conf.Scopes, pkce)
+}
+
+func (p *MastodonProvider) Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error) {
+	return exchangeCode(ctx, p.instanceUri+"/oauth/token", p.conf.ClientId, p.conf.ClientSecret, p.conf.RedirectUri, code, pkce)
+}
+
+type mastodonAccount struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	Acct        string `json:"acct"`
+	DisplayName string `json:"display_name"`
+}
+
+func (p *MastodonProvider) FetchIdentity(ctx context.Context, token *Token) (*Identity, error) {
+
+	var a mastodonAccount
+	err := fetchJson(ctx, p.instanceUri+"/api/v1/accounts/verify_credentials", token.AccessToken, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	acctHandle := a.Acct
+	if !strings.Contains(acctHandle, "@") {
+		acctHandle = a.Username + "@" + strings.TrimPrefix(strings.TrimPrefix(p.instanceUri, "https://"), "http://")
+	}
+
+	return &Identity{
+		Id:            a.Id,
+		Name:          firstNonEmpty(a.DisplayName, a.Username),
+		EmailVerified: false,
+		ExtraClaims: map[string]string{
+			"acct": acctHandle,
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Package providers holds pre-built OIDC/OAuth2 upstream profiles (Google,
+// GitHub, GitLab, Keycloak, Bitbucket, Mastodon, login.gov, and a generic
+// OIDC-discovery fallback) so deployments don't have to hand-configure
+// endpoints and scopes for every identity provider they want to support.
+package providers
+
+import (
+	"context"
+	"time"
+)
+
+// Token is the result of an authorization code exchange.
+type Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time
+	IdToken      string
+}
+
+// Identity is what a Provider resolves an access token to. It mirrors
+// obligator.Identity so the /callback handler can copy the common fields
+// over, plus ExtraClaims for provider-specific data (e.g. a Mastodon acct
+// handle) that doesn't have a home in the common fields. obligator.Identity
+// has no counterpart for ExtraClaims, so /callback does not copy it.
+type Identity struct {
+	Id            string
+	Name          string
+	Email         string
+	EmailVerified bool
+	ExtraClaims   map[string]string
+}
+
+// PKCE carries the verifier/challenge pair for providers and clients using
+// RFC 7636. Either field may be empty when PKCE isn't in use.
+type PKCE struct {
+	Verifier  string
+	Challenge string
+	Method    string // "S256" or "plain"
+}
+
+// Config is the caller-supplied configuration for building a Provider. Not
+// every field applies to every provider type; see each provider's doc
+// comment for which ones it reads.
+type Config struct {
+	Type         string
+	ClientId     string
+	ClientSecret string
+	RedirectUri  string
+	Scopes       []string
+
+	// AuthUri/TokenUri/UserinfoUri are used directly by the generic
+	// OIDC-discovery-based provider, and by the GitLab provider as
+	// overrides of its built-in gitlab.com endpoints. The Keycloak provider
+	// always uses the endpoints from its realm's discovery document.
+	AuthUri     string
+	TokenUri    string
+	UserinfoUri string
+
+	// DiscoveryUri, when set, is used by the generic provider instead of
+	// AuthUri/TokenUri/UserinfoUri.
+	DiscoveryUri string
+
+	// Realm and ServerUri are used by the Keycloak provider to derive
+	// endpoints from {ServerUri}/realms/{Realm}/.well-known/openid-configuration.
+	Realm     string
+	ServerUri string
+
+	// InstanceUri is the Mastodon instance's base URL, e.g. https://mastodon.social.
+	InstanceUri string
+}
+
+// Provider is implemented by every upstream profile in this package.
+type Provider interface {
+	Type() string
+	AuthURL(state string, pkce *PKCE) string
+	Exchange(ctx context.Context, code string, pkce *PKCE) (*Token, error)
+	FetchIdentity(ctx context.Context, token *Token) (*Identity, error)
+}
@@ -0,0 +1,38 @@
+package providers
+
+import "context"
+
+const (
+	TypeGoogle    = "google"
+	TypeGitHub    = "github"
+	TypeGitLab    = "gitlab"
+	TypeKeycloak  = "keycloak"
+	TypeBitbucket = "bitbucket"
+	TypeMastodon  = "mastodon"
+	TypeLoginGov  = "login.gov"
+)
+
+// New builds the Provider for conf.Type, falling back to the generic
+// OIDC-discovery-based provider for any type without a dedicated profile
+// (including an empty Type, for backwards compatibility with existing
+// OAuth2Provider configs).
+func New(ctx context.Context, conf Config) (Provider, error) {
+	switch conf.Type {
+	case TypeGoogle:
+		return NewGoogleProvider(conf), nil
+	case TypeGitHub:
+		return NewGitHubProvider(conf), nil
+	case TypeGitLab:
+		return NewGitLabProvider(conf), nil
+	case TypeKeycloak:
+		return NewKeycloakProvider(ctx, conf)
+	case TypeBitbucket:
+		return NewBitbucketProvider(conf), nil
+	case TypeMastodon:
+		return NewMastodonProvider(conf), nil
+	case TypeLoginGov:
+		return NewLoginGovProvider(conf), nil
+	default:
+		return NewGenericProvider(ctx, conf)
+	}
+}
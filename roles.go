@@ -0,0 +1,181 @@
+package obligator
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// RoleAdmin is the role required to call the role-management and
+// admin-clients endpoints themselves.
+const RoleAdmin = "admin"
+
+// hasRole reports whether roles contains role.
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleRequirement gates a domain/path prefix combination behind a role, so
+// operators can e.g. require "admin" for /admin on a given upstream
+// without having to change the upstream app itself.
+type RoleRequirement struct {
+	Domain     string `json:"domain"`
+	PathPrefix string `json:"path_prefix"`
+	Role       string `json:"role"`
+}
+
+// matchRoleRequirement reports whether roles satisfy the most specific
+// RoleRequirement matching host+path (longest PathPrefix wins). A host/path
+// with no matching requirement is allowed by default.
+func matchRoleRequirement(host, path string, roles []string, reqs []RoleRequirement) bool {
+
+	roleSet := make(map[string]bool, len(roles))
+	for _, r := range roles {
+		roleSet[r] = true
+	}
+
+	allowed := true
+	bestPrefixLen := -1
+
+	for _, req := range reqs {
+		if req.Domain != host {
+			continue
+		}
+
+		if !strings.HasPrefix(path, req.PathPrefix) {
+			continue
+		}
+
+		if len(req.PathPrefix) > bestPrefixLen {
+			bestPrefixLen = len(req.PathPrefix)
+			allowed = roleSet[req.Role]
+		}
+	}
+
+	return allowed
+}
+
+func writeForbidden(w http.ResponseWriter, r *http.Request, tmpl *template.Template, db Database) {
+
+	w.WriteHeader(http.StatusForbidden)
+
+	data := struct {
+		*commonData
+	}{
+		commonData: newCommonData(nil, db, r),
+	}
+
+	err := tmpl.ExecuteTemplate(w, "forbidden.html", data)
+	if err != nil {
+		io.WriteString(w, "Forbidden")
+	}
+}
+
+// RolesHandler serves the admin endpoints for managing roles: which roles
+// a user has, and which role a domain/path prefix requires.
+type RolesHandler struct {
+	mux *http.ServeMux
+}
+
+func NewRolesHandler(db Database, jose *JOSE) *RolesHandler {
+
+	mux := http.NewServeMux()
+	h := &RolesHandler{mux: mux}
+
+	requireAdmin := func(w http.ResponseWriter, r *http.Request) bool {
+		validation, err := validate(db, r, jose, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return false
+		}
+
+		if validation == nil || !hasRole(validation.Roles, RoleAdmin) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "admin role required")
+			return false
+		}
+
+		return true
+	}
+
+	mux.HandleFunc("/roles", func(w http.ResponseWriter, r *http.Request) {
+
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			reqs, err := db.GetRoleRequirements("")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			writeJson(w, reqs)
+		case "POST":
+			var req RoleRequirement
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			err = db.SetRoleRequirement(req.Domain, req.PathPrefix, req.Role)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/assign-role", func(w http.ResponseWriter, r *http.Request) {
+
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			UserId string `json:"user_id"`
+			Role   string `json:"role"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.AssignRole(body.UserId, body.Role)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+	})
+
+	return h
+}
+
+func (h *RolesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
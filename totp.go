@@ -0,0 +1,521 @@
+package obligator
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const DefaultTotpDigits = 6
+const DefaultTotpPeriod = 30 * time.Second
+const totpSkew = 1 // tolerate +-1 period of clock drift
+const RecoveryCodeCount = 10
+
+// ErrTotpRequired is returned by validate() when the identity has TOTP
+// enrolled but the login cookie wasn't issued (or re-issued) with a
+// "2fa_passed" claim, meaning the caller still needs to complete
+// /2fa/verify before being granted access.
+var ErrTotpRequired = errors.New("2fa verification required")
+
+func totpIdentId(idType, id string) string {
+	return idType + ":" + id
+}
+
+func GenerateTotpSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// GenerateTotpCode implements RFC 6238 (TOTP), built on the RFC 4226
+// HOTP algorithm.
+func GenerateTotpCode(secret string, t time.Time, digits int, period time.Duration) (string, error) {
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("totp: invalid secret: %w", err)
+	}
+
+	counter := uint64(t.Unix() / int64(period.Seconds()))
+
+	return hotp(key, counter, digits), nil
+}
+
+func hotp(key []byte, counter uint64, digits int) string {
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	truncated := (uint32(sum[offset])&0x7f)<<24 |
+		uint32(sum[offset+1])<<16 |
+		uint32(sum[offset+2])<<8 |
+		uint32(sum[offset+3])
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	code := truncated % mod
+
+	return fmt.Sprintf("%0*d", digits, code)
+}
+
+// VerifyTotpCode checks code against the TOTP for secret at time t, also
+// accepting the previous/next period to tolerate clock drift.
+func VerifyTotpCode(secret string, code string, t time.Time, digits int, period time.Duration) bool {
+
+	if digits == 0 {
+		digits = DefaultTotpDigits
+	}
+	if period == 0 {
+		period = DefaultTotpPeriod
+	}
+
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		expected, err := GenerateTotpCode(secret, t.Add(time.Duration(skew)*period), digits, period)
+		if err != nil {
+			return false
+		}
+
+		if expected == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TotpProvisioningUri(issuer, accountName, secret string, digits int, period time.Duration) string {
+
+	if digits == 0 {
+		digits = DefaultTotpDigits
+	}
+	if period == 0 {
+		period = DefaultTotpPeriod
+	}
+
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, accountName))
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(digits))
+	q.Set("period", fmt.Sprintf("%d", int(period.Seconds())))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, q.Encode())
+}
+
+// TotpEnrollmentQrSvg renders provisioningUri as an inline QR code SVG, so
+// enrollment never has to call out to an external QR-rendering service.
+func TotpEnrollmentQrSvg(provisioningUri string) (string, error) {
+
+	qr, err := qrcode.New(provisioningUri, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+
+	bitmap := qr.Bitmap()
+	size := len(bitmap)
+	const scale = 4
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size*scale, size*scale)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#ffffff"/>`)
+
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#000000"/>`,
+				x*scale, y*scale, scale, scale)
+		}
+	}
+
+	b.WriteString("</svg>")
+
+	return b.String(), nil
+}
+
+func GenerateRecoveryCodes(n int) ([]string, error) {
+
+	codes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		codes[i] = fmt.Sprintf("%s-%s", raw[:4], raw[4:])
+	}
+
+	return codes, nil
+}
+
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Totp2FAHandler serves the enrollment, verification, disable, and
+// recovery-code endpoints that sit on top of Identity.
+type Totp2FAHandler struct {
+	mux *http.ServeMux
+}
+
+func NewTotp2FAHandler(db Database, tmpl *template.Template, jose *JOSE, digits int, period time.Duration) *Totp2FAHandler {
+
+	if digits == 0 {
+		digits = DefaultTotpDigits
+	}
+	if period == 0 {
+		period = DefaultTotpPeriod
+	}
+
+	mux := http.NewServeMux()
+	h := &Totp2FAHandler{mux: mux}
+
+	currentIdentId := func(r *http.Request) (string, error) {
+		validation, err := validateIgnoringTotp(db, r, jose)
+		if err != nil {
+			return "", err
+		}
+
+		if validation == nil {
+			return "", errors.New("login required")
+		}
+
+		return totpIdentId(validation.IdType, validation.Id), nil
+	}
+
+	// currentIdentIdRequiring2FA behaves like currentIdentId, but for
+	// identities that already have TOTP enrolled, requires the caller to
+	// have already completed /2fa/verify this session (via validate(),
+	// which gates on ErrTotpRequired, rather than validateIgnoringTotp).
+	// Without this, a caller holding only a pre-2FA login cookie could
+	// disable TOTP or silently overwrite the victim's secret and recovery
+	// codes without ever proving they know the existing secret.
+	currentIdentIdRequiring2FA := func(r *http.Request) (string, error) {
+		validation, err := validate(db, r, jose, nil)
+		if err != nil {
+			return "", err
+		}
+
+		if validation == nil {
+			return "", errors.New("login required")
+		}
+
+		return totpIdentId(validation.IdType, validation.Id), nil
+	}
+
+	mux.HandleFunc("/2fa/enroll", func(w http.ResponseWriter, r *http.Request) {
+
+		identId, err := currentIdentId(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		existingSecret, err := db.GetTotpSecret(identId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		// Re-enrolling over an existing secret must prove the caller has
+		// already passed 2FA this session, not just that they hold a
+		// login cookie.
+		if existingSecret != "" {
+			identId, err = currentIdentIdRequiring2FA(r)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		if r.Method == "GET" {
+			secret, err := GenerateTotpSecret()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			displayName, _ := db.GetDisplayName()
+
+			uri := TotpProvisioningUri(displayName, identId, secret, digits, period)
+
+			svg, err := TotpEnrollmentQrSvg(uri)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			data := struct {
+				*commonData
+				Secret string
+				QrSvg  template.HTML
+			}{
+				commonData: newCommonData(nil, db, r),
+				Secret:     secret,
+				QrSvg:      template.HTML(svg),
+			}
+
+			err = tmpl.ExecuteTemplate(w, "2fa-enroll.html", data)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+			}
+
+			return
+		}
+
+		r.ParseForm()
+
+		secret := r.Form.Get("secret")
+		code := r.Form.Get("code")
+
+		if !VerifyTotpCode(secret, code, time.Now(), digits, period) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid code")
+			return
+		}
+
+		err = db.SetTotpSecret(identId, secret)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		for _, rc := range codes {
+			err = db.AddRecoveryCode(identId, HashRecoveryCode(rc))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		data := struct {
+			*commonData
+			RecoveryCodes []string
+		}{
+			commonData:    newCommonData(nil, db, r),
+			RecoveryCodes: codes,
+		}
+
+		err = tmpl.ExecuteTemplate(w, "2fa-recovery-codes.html", data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+		}
+	})
+
+	mux.HandleFunc("/2fa/verify", func(w http.ResponseWriter, r *http.Request) {
+
+		validation, err := validateIgnoringTotp(db, r, jose)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		identId := totpIdentId(validation.IdType, validation.Id)
+
+		if r.Method == "GET" {
+			data := newCommonData(nil, db, r)
+
+			err = tmpl.ExecuteTemplate(w, "2fa-verify.html", data)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+			}
+
+			return
+		}
+
+		r.ParseForm()
+		code := r.Form.Get("code")
+
+		secret, err := db.GetTotpSecret(identId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		ok := secret != "" && VerifyTotpCode(secret, code, time.Now(), digits, period)
+
+		if !ok {
+			ok, err = db.ConsumeRecoveryCode(identId, HashRecoveryCode(code))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "invalid code")
+			return
+		}
+
+		err = mark2FAPassed(r, db, jose, w)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/2fa/disable", func(w http.ResponseWriter, r *http.Request) {
+
+		identId, err := currentIdentIdRequiring2FA(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		err = db.SetTotpSecret(identId, "")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+	})
+
+	mux.HandleFunc("/2fa/recovery-codes", func(w http.ResponseWriter, r *http.Request) {
+
+		identId, err := currentIdentIdRequiring2FA(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		for _, rc := range codes {
+			err = db.AddRecoveryCode(identId, HashRecoveryCode(rc))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		writeJson(w, codes)
+	})
+
+	return h
+}
+
+func (h *Totp2FAHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// mark2FAPassed re-issues the caller's login cookie with a "2fa_passed"
+// claim added, so subsequent validate() calls stop gating on TOTP for the
+// lifetime of the re-issued cookie (loginCookieLifetime, like a fresh login
+// cookie).
+func mark2FAPassed(r *http.Request, db Database, jose *JOSE, w http.ResponseWriter) error {
+
+	loginKeyCookie, err := getLoginCookie(db, r)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := jose.Parse(loginKeyCookie.Value)
+	if err != nil {
+		return err
+	}
+
+	identities, _ := parsed.Get("identities")
+
+	newJwt, err := jose.NewJWT(map[string]interface{}{
+		"identities": identities,
+		"2fa_passed": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	cookieDomain, err := buildCookieDomain(r.Host)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Domain:   cookieDomain,
+		Name:     loginKeyCookie.Name,
+		Value:    newJwt,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   loginCookieLifetime,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}